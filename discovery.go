@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mdnsAddr is the reserved mDNS multicast group and port (RFC 6762),
+// shared with every other zeroconf tool on the LAN - unlike a
+// private multicast address, this is how avahi/Bonjour/dns-sd and this
+// app all rendezvous on the same group.
+const mdnsAddr = "224.0.0.251:5353"
+
+// mdnsRecordTTL is the DNS TTL, in seconds, placed on this peer's PTR/
+// SRV/TXT/A records in a normal announcement. A goodbye instead uses 0
+// (RFC 6762 8.4), telling listeners to remove the entry immediately
+// rather than let it age out.
+const mdnsRecordTTL = 120
+
+// mdnsSRVPort is the numeric TCP port advertised in this peer's SRV
+// record - the same fixed privatePort every peer listens on for private
+// messages.
+var mdnsSRVPort = func() int {
+	port, err := strconv.Atoi(strings.TrimPrefix(privatePort, ":"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return port
+}()
+
+// Discovery finds peers on the local network and reports them via
+// onPeerFound. Implementations run their own goroutines and return
+// once those goroutines are started.
+type Discovery interface {
+	Start() error
+}
+
+// broadcastDiscovery is the original UDP broadcast-based discovery.
+type broadcastDiscovery struct{}
+
+func (broadcastDiscovery) Start() error {
+	go listenForBroadcast()
+	go broadcaster()
+	return nil
+}
+
+// mdnsDiscovery advertises and discovers peers via real mDNS/DNS-SD: a
+// _p2pchat._tcp service on the reserved mDNS group, so other zeroconf
+// tooling (avahi, dns-sd, …) can see this app's peers too, for networks
+// where UDP broadcast is filtered but multicast is not.
+type mdnsDiscovery struct{}
+
+func (mdnsDiscovery) Start() error {
+	go listenMDNS()
+	go announceMDNS()
+	return nil
+}
+
+// discoveryBackends maps -discovery flag values to the Discovery
+// implementations they should start.
+func discoveryBackends(mode string) ([]Discovery, error) {
+	switch mode {
+	case "broadcast":
+		return []Discovery{broadcastDiscovery{}}, nil
+	case "mdns":
+		return []Discovery{mdnsDiscovery{}}, nil
+	case "both":
+		return []Discovery{broadcastDiscovery{}, mdnsDiscovery{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown -discovery value %q (want broadcast, mdns, or both)", mode)
+	}
+}
+
+// onPeerFound records a newly-announced or re-announced peer - identified
+// by its Ed25519 fingerprint rather than its address - and, for peers
+// other than ourselves, opens a persistent connection to them. Both
+// discovery backends call this only after verifyAnnouncement has
+// confirmed fingerprint, pubKeyHex, and the announcement's signature
+// are mutually consistent.
+func onPeerFound(fingerprint, peerName, addr, pubKeyHex string) {
+	self := fingerprint == identity.Fingerprint()
+
+	mutex.Lock()
+	if !self {
+		if _, exists := peers[fingerprint]; !exists {
+			fmt.Printf("Peer discovered: ID=%s, Name=%s, Addr=%s\n", fingerprint, peerName, addr)
+		}
+	}
+	peers[fingerprint] = peerName
+	peerAddrs[fingerprint] = addr
+	peerPubKeys[fingerprint] = pubKeyHex
+	lastActiveTimes[fingerprint] = time.Now()
+	mutex.Unlock()
+
+	if !self {
+		connectToPeer(fingerprint)
+	}
+}
+
+// removePeer deletes fingerprint from every peer-tracking map and tears
+// down its persistent connection, emitting a "Peer left" event so the
+// UI reflects churn. It's called both by reapStalePeers on TTL expiry
+// and immediately on a verified BYE announcement.
+func removePeer(fingerprint string) {
+	if fingerprint == identity.Fingerprint() {
+		return
+	}
+
+	mutex.Lock()
+	peerName, known := peers[fingerprint]
+	if !known {
+		mutex.Unlock()
+		return
+	}
+	fmt.Printf("Peer left: Name=%s\n", peerName)
+	delete(peers, fingerprint)
+	delete(peerAddrs, fingerprint)
+	delete(peerPubKeys, fingerprint)
+	delete(lastActiveTimes, fingerprint)
+	mutex.Unlock()
+
+	peerConns.Remove(fingerprint)
+}
+
+// reapStalePeers periodically scans lastActiveTimes and removes any peer
+// that hasn't been seen in over ttl, i.e. has missed several broadcast
+// intervals. It checks six times per ttl window so a peer is pruned
+// reasonably soon after it actually goes stale.
+func reapStalePeers(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 6)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mutex.Lock()
+		now := time.Now()
+		var stale []string
+		for fingerprint, lastActive := range lastActiveTimes {
+			if now.Sub(lastActive) > ttl {
+				stale = append(stale, fingerprint)
+			}
+		}
+		mutex.Unlock()
+
+		for _, fingerprint := range stale {
+			removePeer(fingerprint)
+		}
+	}
+}
+
+// sendGoodbye announces this peer's graceful departure on every
+// discovery backend currently running, so other peers remove it
+// immediately instead of waiting for -peer-ttl to expire.
+func sendGoodbye() {
+	mutex.Lock()
+	addr := myIP
+	bConn, mConn := broadcastConn, mdnsConn
+	mutex.Unlock()
+
+	env := identity.sign(Envelope{Type: TypeBye, Addr: addr, Body: name, Timestamp: time.Now()})
+
+	if bConn != nil {
+		writeFrame(bConn, env)
+	}
+	if mConn != nil {
+		writeDNSMessage(mConn, dnsAnswersForAnnouncement(env, mdnsSRVPort, 0))
+	}
+}
+
+// listenMDNS listens on the reserved mDNS group (see mdnsAddr) for
+// PTR/SRV/TXT/A announcements of other _p2pchat._tcp instances, and
+// answers any query it sees for that service type with this peer's own
+// announcement - the same thing announceMDNS sends unsolicited every 10
+// seconds, just on demand for a resolver that asked first.
+func listenMDNS() {
+	addr, err := net.ResolveUDPAddr("udp", mdnsAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	udpConn, err := net.ListenMulticastUDP("udp", nil, addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer udpConn.Close()
+	conn := WrapPacketConn(udpConn, fuzz)
+
+	buffer := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		msg, err := decodeDNSMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		if !msg.Response {
+			if queriesServiceType(msg) {
+				go respondToMDNSQuery(conn, addr)
+			}
+			continue
+		}
+
+		env, ok := announcementFromAnswers(msg)
+		if !ok {
+			continue
+		}
+		switch {
+		case env.Type == TypeHello && verifyAnnouncement(env):
+			onPeerFound(env.From, env.Body, env.Addr, env.PubKey)
+		case env.Type == TypeBye && verifyAnnouncement(env):
+			removePeer(env.From)
+		}
+	}
+}
+
+// queriesServiceType reports whether msg, an incoming mDNS query, asks
+// about this app's service type.
+func queriesServiceType(msg dnsMessage) bool {
+	for _, q := range msg.Questions {
+		if q.Name == mdnsServiceType {
+			return true
+		}
+	}
+	return false
+}
+
+// respondToMDNSQuery answers a query for this app's service type with
+// this peer's current HELLO announcement.
+func respondToMDNSQuery(conn net.PacketConn, groupAddr net.Addr) {
+	mutex.Lock()
+	selfAddr := myIP
+	mutex.Unlock()
+	if selfAddr == "" {
+		return
+	}
+	env := identity.sign(Envelope{Type: TypeHello, Addr: selfAddr, Body: name, Timestamp: time.Now()})
+	msg := encodeDNSMessage(true, nil, dnsAnswersForAnnouncement(env, mdnsSRVPort, mdnsRecordTTL))
+	if _, err := conn.WriteTo(msg, groupAddr); err != nil {
+		log.Println("Failed to answer mDNS query:", err)
+	}
+}
+
+// announceMDNS periodically advertises this peer as a _p2pchat._tcp
+// DNS-SD instance on the reserved mDNS group (see mdnsAddr), carrying the
+// user's nickname in the same signed HELLO envelope the broadcast
+// backend uses. A failure to dial its outbound socket - including one
+// injected by -fuzz=drop - is retried with a backoff rather than treated
+// as fatal.
+func announceMDNS() {
+	addr, err := net.ResolveUDPAddr("udp", mdnsAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var conn net.Conn
+	for {
+		if dialFails(fuzz) {
+			log.Println("fuzz: simulated dial failure advertising on mDNS; retrying")
+			time.Sleep(dialRetryBackoff)
+			continue
+		}
+		dialedConn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			log.Println("Failed to dial mDNS group:", err, "; retrying")
+			time.Sleep(dialRetryBackoff)
+			continue
+		}
+		conn = WrapConn(dialedConn, fuzz)
+		break
+	}
+	defer conn.Close()
+	mutex.Lock()
+	mdnsConn = conn
+	mutex.Unlock()
+
+	ip, err := getOutboundIP()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mutex.Lock()
+	myIP = ip.String()
+	mutex.Unlock()
+
+	for {
+		mutex.Lock()
+		selfAddr := myIP
+		mutex.Unlock()
+		env := identity.sign(Envelope{Type: TypeHello, Addr: selfAddr, Body: name, Timestamp: time.Now()})
+		if err := writeDNSMessage(conn, dnsAnswersForAnnouncement(env, mdnsSRVPort, mdnsRecordTTL)); err != nil {
+			log.Fatal(err)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// FuzzMode selects how FuzzedConn, FuzzedPacketConn, and FuzzedListener
+// misbehave. It exists so the gossip dedup, retry, and peer-staleness
+// logic can be exercised under simulated packet loss or latency without
+// a real unreliable network.
+type FuzzMode string
+
+const (
+	// FuzzOff disables fault injection; reads, writes, and dials behave normally.
+	FuzzOff FuzzMode = "off"
+	// FuzzDrop randomly discards reads and writes and fails dials, simulating packet loss.
+	FuzzDrop FuzzMode = "drop"
+	// FuzzDelay sleeps a random duration before every read and write, simulating latency.
+	FuzzDelay FuzzMode = "delay"
+)
+
+// FuzzConfig controls the fault injection applied by FuzzedConn,
+// FuzzedPacketConn, and FuzzedListener, selected via the -fuzz flag.
+type FuzzConfig struct {
+	Mode FuzzMode
+	// MaxDelay bounds the uniformly random sleep FuzzDelay applies before
+	// every read and write.
+	MaxDelay time.Duration
+	// ProbDropRW is the chance, in FuzzDrop mode, that a given read or
+	// write is silently discarded.
+	ProbDropRW float64
+	// ProbDropConn is the chance, in FuzzDrop mode, that a dial fails
+	// outright instead of connecting.
+	ProbDropConn float64
+	// ProbSleep is the chance, in FuzzDelay mode, that a given read or
+	// write is delayed at all, as opposed to passing straight through.
+	ProbSleep float64
+}
+
+// fuzz is the process-wide fault-injection config, set from the -fuzz
+// flag on startup. Its zero value has Mode == "" and injects nothing, so
+// call sites can use it safely even before main's flag.Parse runs.
+var fuzz FuzzConfig
+
+// parseFuzzConfig builds a FuzzConfig from the -fuzz flag value. The
+// probabilities and delay bound are fixed constants, chosen to be
+// disruptive enough to exercise retry and dedup logic without making a
+// manual test session unusable.
+func parseFuzzConfig(mode string) (FuzzConfig, error) {
+	switch FuzzMode(mode) {
+	case FuzzOff:
+		return FuzzConfig{Mode: FuzzOff}, nil
+	case FuzzDrop:
+		return FuzzConfig{Mode: FuzzDrop, ProbDropRW: 0.1, ProbDropConn: 0.2}, nil
+	case FuzzDelay:
+		return FuzzConfig{Mode: FuzzDelay, MaxDelay: 500 * time.Millisecond, ProbSleep: 0.5}, nil
+	default:
+		return FuzzConfig{}, fmt.Errorf("unknown -fuzz value %q (want off, drop, or delay)", mode)
+	}
+}
+
+// sleepFuzz blocks for a uniformly random duration up to cfg.MaxDelay,
+// with probability cfg.ProbSleep, when cfg is in FuzzDelay mode.
+func sleepFuzz(cfg FuzzConfig) {
+	if cfg.Mode != FuzzDelay || cfg.MaxDelay <= 0 {
+		return
+	}
+	if rand.Float64() < cfg.ProbSleep {
+		time.Sleep(time.Duration(rand.Int63n(int64(cfg.MaxDelay) + 1)))
+	}
+}
+
+// FuzzedConn wraps a net.Conn, applying cfg's fault injection to every
+// Read and Write.
+type FuzzedConn struct {
+	net.Conn
+	cfg FuzzConfig
+}
+
+// WrapConn wraps conn in fault injection per cfg, or returns conn
+// unmodified if cfg.Mode is FuzzOff.
+func WrapConn(conn net.Conn, cfg FuzzConfig) net.Conn {
+	if cfg.Mode == FuzzOff {
+		return conn
+	}
+	return FuzzedConn{Conn: conn, cfg: cfg}
+}
+
+// Read drops the data it just read with probability cfg.ProbDropRW in
+// FuzzDrop mode - the bytes are consumed off the wire but never handed
+// back to the caller, simulating a packet that was lost in transit.
+func (c FuzzedConn) Read(b []byte) (int, error) {
+	sleepFuzz(c.cfg)
+	n, err := c.Conn.Read(b)
+	if c.cfg.Mode == FuzzDrop && n > 0 && rand.Float64() < c.cfg.ProbDropRW {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Write silently discards the write with probability cfg.ProbDropRW in
+// FuzzDrop mode, reporting success to the caller without putting
+// anything on the wire, the same way a dropped packet never arrives.
+func (c FuzzedConn) Write(b []byte) (int, error) {
+	sleepFuzz(c.cfg)
+	if c.cfg.Mode == FuzzDrop && rand.Float64() < c.cfg.ProbDropRW {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// dialFails reports whether, per cfg's ProbDropConn, a dial should fail
+// outright instead of being attempted.
+func dialFails(cfg FuzzConfig) bool {
+	return cfg.Mode == FuzzDrop && rand.Float64() < cfg.ProbDropConn
+}
+
+// FuzzedPacketConn wraps a net.PacketConn, applying cfg's fault
+// injection to every ReadFrom and WriteTo.
+type FuzzedPacketConn struct {
+	net.PacketConn
+	cfg FuzzConfig
+}
+
+// WrapPacketConn wraps conn in fault injection per cfg, or returns conn
+// unmodified if cfg.Mode is FuzzOff.
+func WrapPacketConn(conn net.PacketConn, cfg FuzzConfig) net.PacketConn {
+	if cfg.Mode == FuzzOff {
+		return conn
+	}
+	return FuzzedPacketConn{PacketConn: conn, cfg: cfg}
+}
+
+// ReadFrom drops the datagram it just read with probability
+// cfg.ProbDropRW in FuzzDrop mode, the same way FuzzedConn.Read does.
+func (c FuzzedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	sleepFuzz(c.cfg)
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if c.cfg.Mode == FuzzDrop && n > 0 && rand.Float64() < c.cfg.ProbDropRW {
+		return 0, addr, nil
+	}
+	return n, addr, err
+}
+
+// WriteTo silently discards the datagram with probability
+// cfg.ProbDropRW in FuzzDrop mode, the same way FuzzedConn.Write does.
+func (c FuzzedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	sleepFuzz(c.cfg)
+	if c.cfg.Mode == FuzzDrop && rand.Float64() < c.cfg.ProbDropRW {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// FuzzedListener wraps a net.Listener, applying cfg's fault injection to
+// every accepted connection so a fault-injected TLS handshake and
+// message stream can be tested on the inbound private-message path.
+type FuzzedListener struct {
+	net.Listener
+	cfg FuzzConfig
+}
+
+// WrapListener wraps l in fault injection per cfg, or returns l
+// unmodified if cfg.Mode is FuzzOff.
+func WrapListener(l net.Listener, cfg FuzzConfig) net.Listener {
+	if cfg.Mode == FuzzOff {
+		return l
+	}
+	return FuzzedListener{Listener: l, cfg: cfg}
+}
+
+func (l FuzzedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return WrapConn(conn, l.cfg), nil
+}
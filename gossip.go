@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// defaultTTL bounds how many hops a broadcast message may travel before
+// peers stop re-forwarding it.
+const defaultTTL = 8
+
+// seenIDTTL is how long a message ID is remembered for dedup purposes
+// before it is evicted, bounding the size of seenIDs over time.
+const seenIDTTL = 5 * time.Minute
+
+// seenIDs tracks the message IDs this peer has already processed, along
+// with the time they were first seen, so processIncomingMessage can evict
+// old entries instead of growing forever.
+var seenIDs = make(map[string]time.Time)
+
+// newMessageID generates a random 128-bit hex string for a new message.
+func newMessageID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// markSeen records id as seen and evicts any IDs older than seenIDTTL.
+// Callers must hold mutex.
+func markSeen(id string) {
+	now := time.Now()
+	seenIDs[id] = now
+	for seenID, seenAt := range seenIDs {
+		if now.Sub(seenAt) > seenIDTTL {
+			delete(seenIDs, seenID)
+		}
+	}
+}
+
+// alreadySeen reports whether id has been processed before.
+// Callers must hold mutex.
+func alreadySeen(id string) bool {
+	_, ok := seenIDs[id]
+	return ok
+}
+
+// sendBroadcast floods text to every known peer as a gossip message. A
+// broadcast envelope carries no To address; that's how peers distinguish
+// it from a private message.
+func sendBroadcast(text string) {
+	id, err := newMessageID()
+	if err != nil {
+		fmt.Println("Failed to generate message ID:", err)
+		return
+	}
+
+	env := identity.signMessage(Envelope{Type: TypeMsg, Body: text, ID: id, Timestamp: time.Now(), TTL: defaultTTL})
+
+	mutex.Lock()
+	markSeen(env.ID)
+	messages = append(messages, fmt.Sprintf("%s\nFrom: %s", env.Body, name))
+	recipients := make([]string, 0, len(peers))
+	for fingerprint := range peers {
+		recipients = append(recipients, fingerprint)
+	}
+	mutex.Unlock()
+
+	forwardGossipMessage(env, recipients)
+}
+
+// forwardGossipMessage relays env to each recipient fingerprint's
+// persistent connection, decrementing TTL by one hop. The caller is
+// responsible for excluding the peer the message was received from, if any.
+func forwardGossipMessage(env Envelope, recipients []string) {
+	if env.TTL <= 0 {
+		return
+	}
+	forwarded := env
+	forwarded.TTL--
+
+	for _, fingerprint := range recipients {
+		peerConns.Send(fingerprint, forwarded)
+	}
+}
+
+// processIncomingMessage handles an Envelope received over a connection
+// whose client certificate was verified to belong to senderID (see
+// handlePrivateMessage). Broadcast envelopes (To == "") are deduplicated
+// by ID, recorded, and re-forwarded to every other known peer; private
+// envelopes are simply appended to the inbox.
+func processIncomingMessage(env Envelope, senderID string) {
+	if env.Type != TypeMsg {
+		return
+	}
+
+	if env.To != "" {
+		// senderID is TLS-verified to be whoever dialed us directly, so a
+		// private message is attributed to them regardless of env.From.
+		mutex.Lock()
+		messages = append(messages, fmt.Sprintf("%s\nFrom: ID=%s, Name=%s", env.Body, senderID, peers[senderID]))
+		mutex.Unlock()
+		return
+	}
+
+	// Unlike a private message, a gossiped broadcast's author may be many
+	// hops away, so senderID (the relaying neighbor, TLS-verified) says
+	// nothing about who wrote env.Body - only env.Sig does.
+	if !verifyMessage(env) {
+		return
+	}
+
+	mutex.Lock()
+	if alreadySeen(env.ID) {
+		mutex.Unlock()
+		return
+	}
+	markSeen(env.ID)
+	// A gossiped broadcast's From is its original author's fingerprint, not
+	// senderID - the immediate neighbor who relayed it to us, which past the
+	// first hop is someone else entirely. The author may never have been
+	// directly discovered by this node, only reached through relays, in
+	// which case peers[env.From] is empty and the fingerprint is the best
+	// identifying label available.
+	authorName := peers[env.From]
+	if authorName == "" {
+		authorName = env.From
+	}
+	messages = append(messages, fmt.Sprintf("%s\nFrom: %s", env.Body, authorName))
+	recipients := make([]string, 0, len(peers))
+	for fingerprint := range peers {
+		if fingerprint != senderID {
+			recipients = append(recipients, fingerprint)
+		}
+	}
+	mutex.Unlock()
+
+	forwardGossipMessage(env, recipients)
+}
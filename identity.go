@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// identityDir is where the persisted Ed25519 keypair lives, one per user.
+const identityDir = ".p2pchat"
+
+// identityFile is the name of the persisted keypair within identityDir.
+const identityFile = "identity.key"
+
+// certValidity is how long the self-signed TLS certificate derived from
+// the identity key is valid for. It's regenerated fresh every run, so
+// this only needs to outlive a single process's connections.
+const certValidity = 24 * time.Hour
+
+// PeerIdentity is this peer's long-lived Ed25519 keypair. Its public key
+// fingerprint is the canonical peer ID used throughout the app, replacing
+// the IP address a peer happens to be reachable at.
+type PeerIdentity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// loadOrCreateIdentity reads the keypair persisted at ~/.p2pchat/identity.key,
+// generating and persisting a new one on first run.
+func loadOrCreateIdentity() (*PeerIdentity, error) {
+	path, err := identityPath()
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		if len(data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("identity file %s is corrupt", path)
+		}
+		priv := ed25519.PrivateKey(data)
+		return &PeerIdentity{PublicKey: priv.Public().(ed25519.PublicKey), PrivateKey: priv}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, priv, 0600); err != nil {
+		return nil, err
+	}
+	return &PeerIdentity{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+func identityPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, identityDir, identityFile), nil
+}
+
+// Fingerprint is the canonical peer ID derived from the public key: the
+// first 8 bytes of its SHA-256 hash, hex-encoded.
+func (id *PeerIdentity) Fingerprint() string {
+	return fingerprintOf(id.PublicKey)
+}
+
+// PubKeyHex is this identity's public key, hex-encoded for the wire.
+func (id *PeerIdentity) PubKeyHex() string {
+	return hex.EncodeToString(id.PublicKey)
+}
+
+// Sign signs data and returns the hex-encoded signature.
+func (id *PeerIdentity) Sign(data []byte) string {
+	return hex.EncodeToString(ed25519.Sign(id.PrivateKey, data))
+}
+
+// fingerprintOf derives a peer ID from a raw public key.
+func fingerprintOf(pubKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(pubKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// fingerprintOfHex derives a peer ID from a hex-encoded public key,
+// returning "" if pubKeyHex doesn't decode to a valid Ed25519 key.
+func fingerprintOfHex(pubKeyHex string) string {
+	pubKey, err := hex.DecodeString(pubKeyHex)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return ""
+	}
+	return fingerprintOf(pubKey)
+}
+
+// verifySignature checks that sigHex is a valid Ed25519 signature by
+// pubKeyHex over data.
+func verifySignature(pubKeyHex string, data []byte, sigHex string) bool {
+	pubKey, err := hex.DecodeString(pubKeyHex)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pubKey, data, sig)
+}
+
+// announcementSigningInput is the byte string a HELLO/BYE envelope's Sig
+// is computed over: every field an on-path attacker could tamper with to
+// impersonate another peer or change what they're announcing. Type is
+// included so a captured HELLO can't be replayed verbatim with its Type
+// flipped to BYE to evict the victim; Timestamp is included so a captured
+// announcement can't be replayed later as if freshly sent.
+func announcementSigningInput(env Envelope) []byte {
+	return []byte(string(env.Type) + "|" + env.PubKey + "|" + env.Addr + "|" + env.Body + "|" + env.From + "|" + env.Timestamp.UTC().Format(time.RFC3339Nano))
+}
+
+// sign fills in env.PubKey, env.From, and env.Sig using id.
+func (id *PeerIdentity) sign(env Envelope) Envelope {
+	env.PubKey = id.PubKeyHex()
+	env.From = id.Fingerprint()
+	env.Sig = id.Sign(announcementSigningInput(env))
+	return env
+}
+
+// announcementFreshnessWindow bounds how far env.Timestamp may sit from
+// the current time before verifyAnnouncement rejects it as stale. Without
+// this, Timestamp being part of the signed bytes only stops the Timestamp
+// from being tampered with - it does nothing to stop a captured HELLO or
+// BYE from being replayed verbatim at any later time. The window is
+// generous enough to absorb clock drift and a couple of missed 10-second
+// broadcast intervals.
+const announcementFreshnessWindow = 30 * time.Second
+
+// verifyAnnouncement reports whether env is a HELLO/BYE envelope whose
+// From fingerprint, PubKey, and Sig are mutually consistent and whose
+// Timestamp is fresh, rejecting unsigned, spoofed, or replayed
+// announcements.
+func verifyAnnouncement(env Envelope) bool {
+	if env.PubKey == "" || env.Sig == "" {
+		return false
+	}
+	if fingerprintOfHex(env.PubKey) != env.From {
+		return false
+	}
+	if age := time.Since(env.Timestamp); age > announcementFreshnessWindow || age < -announcementFreshnessWindow {
+		return false
+	}
+	return verifySignature(env.PubKey, announcementSigningInput(env), env.Sig)
+}
+
+// messageSigningInput is the byte string a MSG envelope's Sig is computed
+// over: Type, From, To, PubKey, ID, Body, and Timestamp, i.e. everything
+// that identifies who said what, as what message, and when. TTL is
+// deliberately excluded - forwardGossipMessage decrements it on every
+// hop, so a signature covering it would stop verifying after the first
+// relay. PubKey travels with the envelope itself (unlike the lookup
+// verifyAnnouncement does against peerPubKeys) precisely so a gossiped
+// message can be verified by a node that relayed it without ever having
+// directly discovered its author - see verifyMessage.
+func messageSigningInput(env Envelope) []byte {
+	return []byte(string(env.Type) + "|" + env.From + "|" + env.To + "|" + env.PubKey + "|" + env.ID + "|" + env.Body + "|" + env.Timestamp.UTC().Format(time.RFC3339Nano))
+}
+
+// signMessage fills in env.From, env.PubKey, and env.Sig using id, so a
+// MSG envelope's claimed author can be verified rather than trusted
+// outright (see verifyMessage).
+func (id *PeerIdentity) signMessage(env Envelope) Envelope {
+	env.From = id.Fingerprint()
+	env.PubKey = id.PubKeyHex()
+	env.Sig = id.Sign(messageSigningInput(env))
+	return env
+}
+
+// verifyMessage reports whether env's From fingerprint, PubKey, and Sig
+// are mutually consistent - the same self-consistency check
+// verifyAnnouncement uses, reused here so a gossiped broadcast's
+// authorship can be verified purely from what it carries, without
+// requiring this node to have directly discovered the author via a
+// HELLO first. That's what makes genuine multi-hop relaying possible:
+// a node many hops from the original sender still verifies it directly
+// off the envelope, the same way every other hop did.
+func verifyMessage(env Envelope) bool {
+	if env.PubKey == "" || env.Sig == "" {
+		return false
+	}
+	if fingerprintOfHex(env.PubKey) != env.From {
+		return false
+	}
+	return verifySignature(env.PubKey, messageSigningInput(env), env.Sig)
+}
+
+// tlsCertificate builds a self-signed TLS certificate from id's Ed25519
+// key, used as this peer's identity on the TCP private-message channel.
+func (id *PeerIdentity) tlsCertificate() (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id.Fingerprint()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, id.PublicKey, id.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: id.PrivateKey}, nil
+}
+
+// certPublicKey extracts the Ed25519 public key a peer presented in its
+// leaf TLS certificate.
+func certPublicKey(rawCerts [][]byte) (ed25519.PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("no certificate presented")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("certificate key is not Ed25519")
+	}
+	return pub, nil
+}
+
+// pinnedVerifier returns a VerifyPeerCertificate callback for a client
+// dialing a specific peer: the presented certificate's public key must
+// match that peer's advertised key exactly.
+func pinnedVerifier(expectedPubKeyHex string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		pub, err := certPublicKey(rawCerts)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(pub) != expectedPubKeyHex {
+			return fmt.Errorf("peer certificate does not match its advertised public key")
+		}
+		return nil
+	}
+}
+
+// knownPeerVerifier returns a VerifyPeerCertificate callback for the
+// inbound listener: the presented certificate's public key must belong
+// to some peer we've already discovered via a signed announcement.
+func knownPeerVerifier(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	pub, err := certPublicKey(rawCerts)
+	if err != nil {
+		return err
+	}
+	fingerprint := fingerprintOf(pub)
+
+	mutex.Lock()
+	_, known := peerPubKeys[fingerprint]
+	mutex.Unlock()
+	if !known {
+		return fmt.Errorf("certificate %s does not belong to a discovered peer", fingerprint)
+	}
+	return nil
+}
@@ -6,14 +6,16 @@
 // Usage:
 //   - inbox: show all incoming messages
 //   - send $peer_name: send a private message to a peer with $peer_name nickname
-//   - exit: terminate the application.
+//   - broadcast $text: flood a message to every known peer, which re-forward
+//     it to their own peers until its TTL is exhausted
+//   - exit: send a goodbye and terminate the application.
 //
 // Example:
 //
 //	$ chat
 //	Enter your name: YOUR_NAME
 //	> Private listener started
-//	Peer discovered: IP=192.168.1.11, Name=ANOTHER_NAME
+//	Peer discovered: ID=a1b2c3d4e5f6a7b8, Name=ANOTHER_NAME, Addr=192.168.1.11
 //	> send ANOTHER_NAME
 //	Enter message: Hello, peers!
 //	> exit
@@ -21,18 +23,44 @@
 //
 // Networking:
 //
-//	The chat application uses port 8888 for UDP communication (broadcast) and 1234 for TCP (private messages)
+//	The chat application uses port 8888 for UDP communication (broadcast) and 1234 for TCP (private messages).
+//	Peer discovery defaults to UDP broadcast; pass -discovery=mdns to advertise and discover peers as a
+//	_p2pchat._tcp DNS-SD service on the reserved mDNS group instead (see discovery.go and mdns.go), which
+//	also makes peers visible to other zeroconf tooling like avahi or dns-sd, or -discovery=both to run
+//	both backends at once. Every message, on UDP or TCP, is a length-prefixed JSON Envelope (see
+//	wire.go); there is no more ad-hoc text format or fixed-size read.
+//
+// Identity:
+//
+//	Each peer has a persistent Ed25519 keypair (see identity.go), stored at ~/.p2pchat/identity.key
+//	and generated on first run. A peer's public-key fingerprint, not its IP address, is its canonical
+//	ID: it's what peers are keyed by, shown in "send"/"peers", and pinned when dialing a peer's TCP
+//	listener over TLS. UDP announcements are signed so a peer can't be impersonated by spoofing its
+//	nickname.
+//
+// Fault injection:
+//
+//	Pass -fuzz=drop or -fuzz=delay (see fuzz.go) to wrap every TCP and UDP connection in simulated
+//	packet loss or latency, for exercising the gossip dedup, retry, and peer-staleness logic without
+//	a real unreliable network. Defaults to -fuzz=off.
+//
+// Presence:
+//
+//	A peer that goes -peer-ttl (default 60s) without a fresh HELLO is pruned and reported as
+//	"Peer left"; exit sends a signed BYE first so well-behaved departures are noticed immediately
+//	instead of waiting out the TTL.
 //
 // Package main provides the main function and related functions for the chat application.
 package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -44,6 +72,12 @@ const (
 	broadcastPort = ":8888"
 )
 
+// dialRetryBackoff is how long a discovery announcer waits before retrying
+// after failing to dial its outbound socket, including a failure injected
+// by -fuzz=drop - that's a transient condition the process should ride out,
+// not a reason to exit.
+const dialRetryBackoff = time.Second
+
 // Peer stores a dicovered peer information
 type Peer struct {
 	IP   string
@@ -54,29 +88,77 @@ type Peer struct {
 var (
 	// name represents user nickname and is initialized on startup
 	name string
-	// myIP - deprecated
+	// myIP is this peer's outbound address, advertised in announcements.
+	// Guarded by mutex like every other field in this block.
 	myIP string
-	// peers is a map of discovered peers. Todo - remove peer if it is inactive for more than N minutes
+	// identity is this peer's persistent Ed25519 keypair, loaded on startup
+	identity *PeerIdentity
+	// selfCert is the self-signed TLS certificate derived from identity
+	selfCert tls.Certificate
+	// peers maps a peer's fingerprint (see identity.go) to its nickname
 	peers = make(map[string]string)
+	// peerAddrs maps a peer's fingerprint to its last-known network address
+	peerAddrs = make(map[string]string)
+	// peerPubKeys maps a peer's fingerprint to its advertised Ed25519 public key
+	peerPubKeys = make(map[string]string)
 	// messages stores all inbox messages
 	messages []string
 	// mutex - synchronization primitive
 	mutex sync.Mutex
 	// lastActiveTimes - the last time when a user was online
 	lastActiveTimes = make(map[string]time.Time) // Initialize lastActiveTimes map
+	// broadcastConn is the outbound UDP connection the broadcast discovery
+	// backend's announcer dials, kept so sendGoodbye can reuse it on exit.
+	// Guarded by mutex like every other field in this block.
+	broadcastConn net.Conn
+	// mdnsConn is the outbound UDP connection the mDNS discovery backend's
+	// announcer dials, kept so sendGoodbye can reuse it on exit. Guarded by
+	// mutex like every other field in this block.
+	mdnsConn net.Conn
 )
 
 func main() {
+	discoveryMode := flag.String("discovery", "broadcast", "peer discovery backend(s) to use: broadcast, mdns, or both")
+	fuzzMode := flag.String("fuzz", "off", "fault injection for all connections: off, drop, or delay")
+	peerTTL := flag.Duration("peer-ttl", 60*time.Second, "how long a peer may go unseen before it is pruned")
+	flag.Parse()
+
+	backends, err := discoveryBackends(*discoveryMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fuzz, err = parseFuzzConfig(*fuzzMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *peerTTL <= 0 {
+		log.Fatalf("-peer-ttl must be positive, got %s", *peerTTL)
+	}
+
+	identity, err = loadOrCreateIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	selfCert, err = identity.tlsCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Print("Enter your name: ")
 	name, _ = reader.ReadString('\n')
 	name = strings.TrimSpace(name)
 
-	// Start private listener, broadcast listener, and broadcaster in separate goroutines
+	// Start the private listener, the selected discovery backend(s), and
+	// the reaper that prunes peers that have gone quiet for -peer-ttl.
 	go listenForPrivateMessages()
-	go listenForBroadcast()
-	go broadcaster()
+	for _, backend := range backends {
+		if err := backend.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go reapStalePeers(*peerTTL)
 
 	for {
 		fmt.Print("> ")
@@ -90,11 +172,15 @@ func main() {
 			showInbox()
 		case "exit":
 			fmt.Println("Exiting...")
+			sendGoodbye()
 			return
 		default:
 			if strings.HasPrefix(input, "send ") {
 				peerName := strings.TrimSpace(strings.TrimPrefix(input, "send "))
 				sendMessage(peerName)
+			} else if strings.HasPrefix(input, "broadcast ") {
+				text := strings.TrimPrefix(input, "broadcast ")
+				sendBroadcast(text)
 			} else {
 				fmt.Println("Invalid command.")
 			}
@@ -102,12 +188,21 @@ func main() {
 	}
 }
 
-// listenForPrivateMessages waits for all private messages
+// listenForPrivateMessages waits for all private messages. The listener
+// requires a client certificate from every connecting peer and rejects
+// any whose public key doesn't belong to an already-discovered peer.
 func listenForPrivateMessages() {
-	l, err := net.Listen("tcp", privatePort)
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{selfCert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: knownPeerVerifier,
+	}
+
+	rawListener, err := net.Listen("tcp", privatePort)
 	if err != nil {
 		log.Fatal(err)
 	}
+	l := tls.NewListener(WrapListener(rawListener, fuzz), config)
 	defer l.Close()
 
 	fmt.Println("Private listener started.")
@@ -117,29 +212,41 @@ func listenForPrivateMessages() {
 			log.Fatal(err)
 		}
 
-		// Extract the sender's IP from the connection object
-		senderIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-		if err != nil {
-			log.Fatal(err)
-		}
+		go acceptPrivateConn(conn)
+	}
+}
 
-		go handlePrivateMessage(conn, senderIP)
+// acceptPrivateConn completes conn's TLS handshake and, once the peer's
+// certificate yields a fingerprint, hands the connection off to
+// handlePrivateMessage. This runs in its own goroutine per connection -
+// rather than inline in listenForPrivateMessages' Accept loop - so one
+// slow or malicious peer's handshake can't stall every other peer's
+// connection attempt behind it.
+func acceptPrivateConn(conn net.Conn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.Handshake() != nil {
+		conn.Close()
+		return
+	}
+	pub, err := certPublicKey([][]byte{tlsConn.ConnectionState().PeerCertificates[0].Raw})
+	if err != nil {
+		conn.Close()
+		return
 	}
+
+	handlePrivateMessage(conn, fingerprintOf(pub))
 }
 
-func handlePrivateMessage(conn net.Conn, senderIP string) {
+func handlePrivateMessage(conn net.Conn, senderID string) {
 	defer conn.Close()
 
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		log.Fatal(err)
+	for {
+		env, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		processIncomingMessage(env, senderID)
 	}
-
-	message := string(buffer[:n])
-	mutex.Lock()
-	messages = append(messages, fmt.Sprintf("%s\nFrom: IP=%s, Name=%s", message, senderIP, peers[senderIP]))
-	mutex.Unlock()
 }
 
 // listenForPeers listens for UDP broadcast messages to discover peers
@@ -148,77 +255,77 @@ func listenForBroadcast() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	udpConn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	defer udpConn.Close()
+	conn := WrapPacketConn(udpConn, fuzz)
 
 	buffer := make([]byte, 1024)
 	for {
-		n, _, err := conn.ReadFromUDP(buffer)
+		n, _, err := conn.ReadFrom(buffer)
 		if err != nil {
 			log.Fatal(err)
 		}
-		message := string(buffer[:n])
-		ip, peerName := parseBroadcastMessage(message)
-		if ip != "" && peerName != "" {
-			mutex.Lock()
-			// Skip printing if the message is about our own IP
-			if ip != myIP {
-				// Skip printing if the peer has already been discovered before
-				if _, exists := peers[ip]; !exists {
-					fmt.Printf("Peer discovered: IP=%s, Name=%s\n", ip, peerName)
-				}
-			}
-			// Update the peer's name in the peers map
-			peers[ip] = peerName
-			// Update the last active time of the peer
-			lastActiveTimes[ip] = time.Now()
-			mutex.Unlock()
+		env, err := readFrameFromDatagram(buffer[:n])
+		if err != nil {
+			continue
+		}
+		switch {
+		case env.Type == TypeHello && verifyAnnouncement(env):
+			onPeerFound(env.From, env.Body, env.Addr, env.PubKey)
+		case env.Type == TypeBye && verifyAnnouncement(env):
+			removePeer(env.From)
 		}
 	}
 }
 
-func parseBroadcastMessage(message string) (string, string) {
-	re := regexp.MustCompile(`IP: (\d+\.\d+\.\d+\.\d+), Name: (.+)`)
-	match := re.FindStringSubmatch(message)
-	if len(match) >= 3 {
-		ip := match[1]
-		peerName := match[2]
-		return ip, peerName
-	}
-	return "", ""
-}
-
-// broadcaster notifies other peers every 10 seconds
+// broadcaster notifies other peers every 10 seconds. A failure to dial its
+// outbound socket - including one injected by -fuzz=drop - is retried with
+// a backoff rather than treated as fatal.
 func broadcaster() {
-	conn, err := net.Dial("udp", "255.255.255.255"+broadcastPort)
-	if err != nil {
-		log.Fatal(err)
+	var conn net.Conn
+	for {
+		if dialFails(fuzz) {
+			log.Println("fuzz: simulated dial failure broadcasting; retrying")
+			time.Sleep(dialRetryBackoff)
+			continue
+		}
+		dialedConn, err := net.Dial("udp", "255.255.255.255"+broadcastPort)
+		if err != nil {
+			log.Println("Failed to dial broadcast address:", err, "; retrying")
+			time.Sleep(dialRetryBackoff)
+			continue
+		}
+		conn = WrapConn(dialedConn, fuzz)
+		break
 	}
 	defer conn.Close()
+	mutex.Lock()
+	broadcastConn = conn
+	mutex.Unlock()
 
 	ip, err := getOutboundIP()
 	if err != nil {
 		log.Fatal(err)
 	}
+	mutex.Lock()
 	myIP = ip.String()
+	mutex.Unlock()
 
 	for {
-		broadcastMessage(fmt.Sprintf("IP: %s, Name: %s", myIP, name), conn)
+		mutex.Lock()
+		addr := myIP
+		mutex.Unlock()
+		env := identity.sign(Envelope{Type: TypeHello, Addr: addr, Body: name, Timestamp: time.Now()})
+		if err := writeFrame(conn, env); err != nil {
+			log.Fatal(err)
+		}
 		time.Sleep(10 * time.Second)
 	}
 }
 
-// broadcastMessage is used to broadcast messages
-func broadcastMessage(message string, conn net.Conn) {
-	_, err := conn.Write([]byte(message))
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func getOutboundIP() (net.IP, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
@@ -236,30 +343,31 @@ func showPeers() {
 	defer mutex.Unlock()
 
 	fmt.Println("Peers:")
-	for ip, name := range peers {
-		fmt.Printf("Name: %s, IP: %s\n", name, ip)
+	for fingerprint, peerName := range peers {
+		fmt.Printf("Name: %s, ID: %s, Addr: %s\n", peerName, fingerprint, peerAddrs[fingerprint])
 	}
 }
 
 // sendMessage sends a message from command input to the peerName
 func sendMessage(peerName string) {
 	mutex.Lock()
-	defer mutex.Unlock()
-
-	targetIP := ""
-	for ip, name := range peers {
-		if name == peerName {
-			targetIP = ip
+	targetID := ""
+	for fingerprint, n := range peers {
+		if n == peerName {
+			targetID = fingerprint
 			break
 		}
 	}
 
-	if targetIP == "" {
+	if targetID == "" {
+		mutex.Unlock()
 		fmt.Println("Peer not found.")
 		return
 	}
 
-	lastActiveTime, found := lastActiveTimes[targetIP]
+	lastActiveTime, found := lastActiveTimes[targetID]
+	mutex.Unlock()
+
 	if found && time.Since(lastActiveTime) > time.Minute {
 		fmt.Println("Warning: The peer has not been active for more than a minute.")
 	}
@@ -269,15 +377,16 @@ func sendMessage(peerName string) {
 	message, _ := reader.ReadString('\n')
 	message = strings.TrimSpace(message)
 
-	conn, err := net.Dial("tcp", targetIP+privatePort)
+	id, err := newMessageID()
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Failed to generate message ID:", err)
+		return
 	}
-	defer conn.Close()
 
-	_, err = conn.Write([]byte(message))
-	if err != nil {
-		log.Fatal(err)
+	connectToPeer(targetID)
+	env := identity.signMessage(Envelope{Type: TypeMsg, To: targetID, ID: id, Body: message, Timestamp: time.Now()})
+	if !peerConns.Send(targetID, env) {
+		fmt.Println("Failed to send message to", peerName)
 	}
 }
 
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// This file hand-rolls just enough of DNS-SD (RFC 6763) over mDNS
+// (RFC 6762) to advertise this app as a discoverable _p2pchat._tcp
+// service and to parse other instances' advertisements back out -
+// following wire.go's precedent of encoding the wire format directly
+// rather than pulling in a library, since this module carries no
+// dependencies.
+//
+// One corner is deliberately cut: this package never reads or writes
+// compressed names (RFC 1035 4.1.4, the 0xC0 pointer scheme real
+// resolvers use to avoid repeating names). It always writes names out in
+// full and rejects a compressed name on decode. That keeps the decoder
+// simple and is harmless for messages this program - or another instance
+// of it - produces, since every name here is short and appears once. A
+// strict third-party resolver that compresses its own queries to us would
+// still be answered correctly (we don't need to decode its query to
+// respond), but a name this package cannot decode in someone else's
+// response is skipped rather than fatal.
+
+// dnsTypeA, dnsTypePTR, dnsTypeTXT, and dnsTypeSRV are the RFC 1035/2782
+// resource record type numbers this package emits and understands.
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+// dnsFlagResponse is the QR bit (RFC 1035 4.1.1): set on a reply, clear
+// on a query.
+const dnsFlagResponse = 1 << 15
+
+// mdnsServiceType is this app's DNS-SD service type. A PTR query for this
+// name is how other zeroconf tooling (avahi, dns-sd, …) discovers
+// instances of this app on the LAN.
+const mdnsServiceType = "_p2pchat._tcp.local."
+
+// encodeDNSName encodes a dot-separated DNS name as a sequence of
+// length-prefixed labels terminated by a zero-length label.
+func encodeDNSName(name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	var buf []byte
+	for _, label := range strings.Split(name, ".") {
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+// decodeDNSName reads a DNS name starting at offset in msg and returns it
+// (dot-separated, with a trailing dot) plus the offset immediately past
+// it. It returns an error on a compressed name (see the file comment) or
+// on a name that runs past the end of msg.
+func decodeDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", 0, errors.New("dns name runs past end of message")
+		}
+		length := int(msg[offset])
+		if length&0xC0 != 0 {
+			return "", 0, errors.New("compressed dns names are not supported")
+		}
+		offset++
+		if length == 0 {
+			break
+		}
+		if offset+length > len(msg) {
+			return "", 0, errors.New("dns label runs past end of message")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	return strings.Join(labels, ".") + ".", offset, nil
+}
+
+// dnsQuestion is a parsed entry from a message's question section.
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// dnsRR is a parsed resource record from a message's answer section.
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	RData []byte
+}
+
+// dnsMessage is the subset of a DNS message this package builds and
+// parses: a header's question/answer counts, the questions themselves,
+// and the answer records. The authority and additional sections are
+// never populated or inspected.
+type dnsMessage struct {
+	Response  bool
+	Questions []dnsQuestion
+	Answers   []dnsRR
+}
+
+// encodeQuestion encodes q as it appears on the wire: its name followed
+// by a 2-byte type and 2-byte class.
+func encodeQuestion(q dnsQuestion) []byte {
+	buf := encodeDNSName(q.Name)
+	var tail [4]byte
+	binary.BigEndian.PutUint16(tail[0:2], q.Type)
+	binary.BigEndian.PutUint16(tail[2:4], q.Class)
+	return append(buf, tail[:]...)
+}
+
+// encodeRR encodes rr as it appears on the wire: its name, type, class,
+// TTL, and length-prefixed rdata.
+func encodeRR(rr dnsRR) []byte {
+	buf := encodeDNSName(rr.Name)
+	var tail [10]byte
+	binary.BigEndian.PutUint16(tail[0:2], rr.Type)
+	binary.BigEndian.PutUint16(tail[2:4], rr.Class)
+	binary.BigEndian.PutUint32(tail[4:8], rr.TTL)
+	binary.BigEndian.PutUint16(tail[8:10], uint16(len(rr.RData)))
+	buf = append(buf, tail[:]...)
+	return append(buf, rr.RData...)
+}
+
+// encodeDNSMessage serializes a full DNS message: a 12-byte header
+// (ID and flags 0, or dnsFlagResponse if resp) followed by the encoded
+// questions and answers.
+func encodeDNSMessage(resp bool, questions []dnsQuestion, answers []dnsRR) []byte {
+	header := make([]byte, 12)
+	if resp {
+		binary.BigEndian.PutUint16(header[2:4], dnsFlagResponse)
+	}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(questions)))
+	binary.BigEndian.PutUint16(header[6:8], uint16(len(answers)))
+
+	buf := header
+	for _, q := range questions {
+		buf = append(buf, encodeQuestion(q)...)
+	}
+	for _, rr := range answers {
+		buf = append(buf, encodeRR(rr)...)
+	}
+	return buf
+}
+
+// decodeDNSMessage parses msg into a dnsMessage. It stops and returns
+// whatever it has successfully parsed so far - rather than failing the
+// whole message - the moment it hits a record it can't decode (e.g. a
+// compressed name from a third-party resolver), since the records
+// already parsed are still usable.
+func decodeDNSMessage(msg []byte) (dnsMessage, error) {
+	if len(msg) < 12 {
+		return dnsMessage{}, errors.New("dns message shorter than header")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	qdCount := int(binary.BigEndian.Uint16(msg[4:6]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	out := dnsMessage{Response: flags&dnsFlagResponse != 0}
+	offset := 12
+
+	for i := 0; i < qdCount; i++ {
+		name, next, err := decodeDNSName(msg, offset)
+		if err != nil || next+4 > len(msg) {
+			return out, nil
+		}
+		out.Questions = append(out.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next : next+2]),
+			Class: binary.BigEndian.Uint16(msg[next+2 : next+4]),
+		})
+		offset = next + 4
+	}
+
+	for i := 0; i < anCount; i++ {
+		name, next, err := decodeDNSName(msg, offset)
+		if err != nil || next+10 > len(msg) {
+			return out, nil
+		}
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8 : next+10]))
+		rdStart := next + 10
+		if rdStart+rdlen > len(msg) {
+			return out, nil
+		}
+		out.Answers = append(out.Answers, dnsRR{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[next : next+2]),
+			Class: binary.BigEndian.Uint16(msg[next+2 : next+4]),
+			TTL:   binary.BigEndian.Uint32(msg[next+4 : next+8]),
+			RData: msg[rdStart : rdStart+rdlen],
+		})
+		offset = rdStart + rdlen
+	}
+
+	return out, nil
+}
+
+// encodeTXT packs pairs into DNS-SD TXT rdata: a sequence of
+// length-prefixed "key=value" character-strings (RFC 6763 6). Every
+// value this package writes is well under the 255-byte character-string
+// limit, so no entry needs splitting across more than one string.
+func encodeTXT(pairs map[string]string) []byte {
+	var buf []byte
+	for k, v := range pairs {
+		s := k + "=" + v
+		buf = append(buf, byte(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// decodeTXT unpacks DNS-SD TXT rdata produced by encodeTXT back into a
+// key/value map. A malformed or unrecognized character-string is
+// skipped rather than failing the whole record.
+func decodeTXT(rdata []byte) map[string]string {
+	out := make(map[string]string)
+	for offset := 0; offset < len(rdata); {
+		length := int(rdata[offset])
+		offset++
+		if offset+length > len(rdata) {
+			break
+		}
+		kv := string(rdata[offset : offset+length])
+		if eq := strings.IndexByte(kv, '='); eq >= 0 {
+			out[kv[:eq]] = kv[eq+1:]
+		}
+		offset += length
+	}
+	return out
+}
+
+// writeDNSMessage writes an unsolicited response message carrying
+// answers to w.
+func writeDNSMessage(w io.Writer, answers []dnsRR) error {
+	_, err := w.Write(encodeDNSMessage(true, nil, answers))
+	return err
+}
+
+// dnsAnswersForAnnouncement builds the PTR/SRV/TXT/A answer records that
+// advertise env - a signed HELLO/BYE (see identity.go) - as a
+// _p2pchat._tcp DNS-SD instance reachable at env.Addr:port. rrTTL is the
+// DNS TTL placed on every record; a goodbye uses 0 (RFC 6762 8.4) so
+// listeners drop the entry immediately instead of letting it age out.
+func dnsAnswersForAnnouncement(env Envelope, port int, rrTTL uint32) []dnsRR {
+	instance := env.From + "." + mdnsServiceType
+	target := env.From + ".local."
+
+	txt := encodeTXT(map[string]string{
+		"type": string(env.Type),
+		"pub":  env.PubKey,
+		"sig":  env.Sig,
+		"ts":   env.Timestamp.UTC().Format(time.RFC3339Nano),
+		"name": env.Body,
+	})
+
+	srvRData := make([]byte, 6) // priority(2)=0, weight(2)=0, port(2)
+	binary.BigEndian.PutUint16(srvRData[4:6], uint16(port))
+	srvRData = append(srvRData, encodeDNSName(target)...)
+
+	answers := []dnsRR{
+		{Name: mdnsServiceType, Type: dnsTypePTR, Class: dnsClassIN, TTL: rrTTL, RData: encodeDNSName(instance)},
+		{Name: instance, Type: dnsTypeSRV, Class: dnsClassIN, TTL: rrTTL, RData: srvRData},
+		{Name: instance, Type: dnsTypeTXT, Class: dnsClassIN, TTL: rrTTL, RData: txt},
+	}
+	if v4 := net.ParseIP(env.Addr).To4(); v4 != nil {
+		answers = append(answers, dnsRR{Name: target, Type: dnsTypeA, Class: dnsClassIN, TTL: rrTTL, RData: v4})
+	}
+	return answers
+}
+
+// announcementFromAnswers reconstructs the signed Envelope carried by a
+// DNS-SD instance's PTR/SRV/TXT/A records in msg, or reports ok = false
+// if msg doesn't yet carry a complete enough set to do so - e.g. only the
+// PTR has arrived so far, or it's advertising a different service type.
+// The caller is still responsible for running the result through
+// verifyAnnouncement before trusting it; this only parses the wire
+// format back into an Envelope.
+func announcementFromAnswers(msg dnsMessage) (env Envelope, ok bool) {
+	// This peer's SRV port isn't captured separately below: every peer
+	// advertises the same fixed privatePort, and connectToPeer already
+	// dials it directly, so only the SRV record's target name (for the
+	// matching A record) is of interest here.
+	var instance string
+	txts := make(map[string]map[string]string)
+	targets := make(map[string]string)
+	ips := make(map[string]string)
+
+	for _, rr := range msg.Answers {
+		switch rr.Type {
+		case dnsTypePTR:
+			if rr.Name == mdnsServiceType {
+				if name, _, err := decodeDNSName(rr.RData, 0); err == nil {
+					instance = name
+				}
+			}
+		case dnsTypeTXT:
+			txts[rr.Name] = decodeTXT(rr.RData)
+		case dnsTypeSRV:
+			if len(rr.RData) >= 6 {
+				if target, _, err := decodeDNSName(rr.RData, 6); err == nil {
+					targets[rr.Name] = target
+				}
+			}
+		case dnsTypeA:
+			if len(rr.RData) == 4 {
+				ips[rr.Name] = net.IP(rr.RData).String()
+			}
+		}
+	}
+	if instance == "" {
+		return Envelope{}, false
+	}
+
+	fields, haveTXT := txts[instance]
+	target, haveSRV := targets[instance]
+	if !haveTXT || !haveSRV {
+		return Envelope{}, false
+	}
+	ip, haveA := ips[target]
+	if !haveA {
+		return Envelope{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, fields["ts"])
+	if err != nil {
+		return Envelope{}, false
+	}
+
+	fingerprint := strings.TrimSuffix(instance, "."+mdnsServiceType)
+	env = Envelope{
+		Type:      EnvelopeType(fields["type"]),
+		From:      fingerprint,
+		Body:      fields["name"],
+		Timestamp: ts,
+		PubKey:    fields["pub"],
+		Addr:      ip,
+		Sig:       fields["sig"],
+	}
+	return env, true
+}
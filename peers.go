@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"time"
+)
+
+// connStaleThreshold bounds how long a persistent peer connection is kept
+// open after its last broadcast sighting before it is torn down.
+const connStaleThreshold = 30 * time.Second
+
+// outboxSize is the buffer depth of each peer's outbound channel, enough
+// to absorb a burst of gossip forwards without blocking the sender.
+const outboxSize = 32
+
+// Peers is a registry of persistent outbound TCP connections, one per
+// discovered peer fingerprint, each drained by its own dialer goroutine.
+// It replaces dialing a fresh connection for every message.
+type Peers struct {
+	conns map[string]chan Envelope
+}
+
+// peerConns is the process-wide persistent connection registry.
+var peerConns = &Peers{conns: make(map[string]chan Envelope)}
+
+// Add registers fingerprint in the registry and returns the channel that
+// a new dialer goroutine should drain. It returns nil if fingerprint is
+// already registered, so callers know not to spawn a second dialer.
+func (p *Peers) Add(fingerprint string) <-chan Envelope {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, exists := p.conns[fingerprint]; exists {
+		return nil
+	}
+	ch := make(chan Envelope, outboxSize)
+	p.conns[fingerprint] = ch
+	return ch
+}
+
+// Remove tears down the registered channel for fingerprint, if any,
+// causing its dialer goroutine to stop once it drains any pending
+// messages.
+func (p *Peers) Remove(fingerprint string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if ch, exists := p.conns[fingerprint]; exists {
+		close(ch)
+		delete(p.conns, fingerprint)
+	}
+}
+
+// Send enqueues msg on fingerprint's outbound channel. It reports false
+// if fingerprint has no persistent connection or its outbox is full.
+func (p *Peers) Send(fingerprint string, msg Envelope) bool {
+	mutex.Lock()
+	ch, exists := p.conns[fingerprint]
+	mutex.Unlock()
+	if !exists {
+		return false
+	}
+	select {
+	case ch <- msg:
+		return true
+	default:
+		log.Println("Outbox full for peer", fingerprint, "- dropping message")
+		return false
+	}
+}
+
+// dialPeer owns the long-lived outbound connection to fingerprint: it
+// dials its last-known address over TLS, pinning the presented
+// certificate to the key fingerprint advertised, then encodes every
+// Envelope sent on ch until the channel is closed or the connection
+// errors, at which point it removes itself from the registry so a later
+// discovery can retry.
+func dialPeer(fingerprint string, ch <-chan Envelope) {
+	mutex.Lock()
+	addr := peerAddrs[fingerprint]
+	pubKeyHex := peerPubKeys[fingerprint]
+	mutex.Unlock()
+
+	config := &tls.Config{
+		Certificates:          []tls.Certificate{selfCert},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: pinnedVerifier(pubKeyHex),
+	}
+
+	if dialFails(fuzz) {
+		log.Println("fuzz: simulated dial failure to peer", fingerprint)
+		peerConns.Remove(fingerprint)
+		return
+	}
+	dialedConn, err := tls.Dial("tcp", addr+privatePort, config)
+	if err != nil {
+		log.Println("Failed to connect to peer", fingerprint, ":", err)
+		peerConns.Remove(fingerprint)
+		return
+	}
+	conn := WrapConn(dialedConn, fuzz)
+	defer conn.Close()
+
+	for {
+		select {
+		case env, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeFrame(conn, env); err != nil {
+				log.Println("Failed to send to peer", fingerprint, ":", err)
+				peerConns.Remove(fingerprint)
+				return
+			}
+		case <-time.After(connStaleThreshold):
+			mutex.Lock()
+			lastActive, seen := lastActiveTimes[fingerprint]
+			mutex.Unlock()
+			if !seen || time.Since(lastActive) > connStaleThreshold {
+				peerConns.Remove(fingerprint)
+				return
+			}
+		}
+	}
+}
+
+// connectToPeer spawns a dialer for fingerprint if one is not already
+// running.
+func connectToPeer(fingerprint string) {
+	if ch := peerConns.Add(fingerprint); ch != nil {
+		go dialPeer(fingerprint, ch)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EnvelopeType identifies what an Envelope carries, so the wire format can
+// grow new message kinds without breaking peers that don't understand them.
+type EnvelopeType string
+
+const (
+	// TypeHello announces a peer's presence (nickname + address).
+	TypeHello EnvelopeType = "HELLO"
+	// TypeBye announces a peer is leaving gracefully.
+	TypeBye EnvelopeType = "BYE"
+	// TypeMsg carries a chat message, private or gossiped.
+	TypeMsg EnvelopeType = "MSG"
+	// TypeAck acknowledges receipt of a message.
+	TypeAck EnvelopeType = "ACK"
+)
+
+// Envelope is the single wire format used for UDP announcements and TCP
+// private/broadcast messages alike. It replaces the ad-hoc "IP: X, Name: Y"
+// text format and the unframed byte reads the TCP path used to use.
+//
+// From is always the sender's identity fingerprint (see identity.go), not
+// an address - a peer's network address can change without changing who
+// they are. PubKey and Sig are populated on HELLO/BYE and MSG alike, but
+// signed and verified differently (see announcementSigningInput and
+// messageSigningInput): in both cases PubKey is the claimed author's
+// Ed25519 public key and recipients check that it hashes to From before
+// trusting Sig, which is what lets a gossiped MSG be verified by a node
+// that never directly discovered its author via HELLO. Addr is HELLO/BYE
+// only: the sender's current network address.
+type Envelope struct {
+	Type      EnvelopeType
+	From      string
+	To        string // empty for a gossiped broadcast, a peer fingerprint for a private message
+	ID        string
+	Body      string
+	Timestamp time.Time
+	PubKey    string // sender's Ed25519 public key, hex-encoded; see the type doc comment
+	Addr      string // HELLO/BYE only: sender's current network address
+	Sig       string // HELLO/BYE: signature over the announcement fields; MSG: signature over the message fields
+	TTL       int    // hops remaining for a gossiped broadcast; unused otherwise
+}
+
+// writeFrame writes env to w as a 4-byte big-endian length prefix followed
+// by its JSON encoding, so readFrame can recover exactly one Envelope per
+// call regardless of how the underlying transport chunks writes and reads.
+func writeFrame(w io.Writer, env Envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// maxFrameSize bounds the length prefix readFrame will honor, so a peer
+// can't force an arbitrarily large allocation by declaring a length close
+// to the uint32 limit. It comfortably fits the largest legitimate
+// Envelope (a gossiped chat message) with headroom to spare.
+const maxFrameSize = 1 << 20 // 1 MiB
+
+// readFrame reads one length-prefixed Envelope from r. Over a TCP
+// connection this blocks until a full frame has arrived, however many
+// underlying reads that takes; over an in-memory buffer (e.g. a decoded
+// UDP datagram) it simply parses what's already there.
+func readFrame(r io.Reader) (Envelope, error) {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return Envelope{}, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length > maxFrameSize {
+		return Envelope{}, fmt.Errorf("frame length %d exceeds max %d", length, maxFrameSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Envelope{}, err
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return Envelope{}, err
+	}
+	return env, nil
+}
+
+// readFrameFromDatagram parses a single Envelope out of a whole UDP
+// datagram already read into memory. UDP has no byte-stream semantics, so
+// readFrame's two reads can't be issued directly against the socket - the
+// second read would consume part of the next datagram instead of the rest
+// of this one.
+func readFrameFromDatagram(datagram []byte) (Envelope, error) {
+	return readFrame(bytes.NewReader(datagram))
+}